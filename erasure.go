@@ -0,0 +1,502 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Этот файл реализует необязательный режим эразур-кодирования поверх
+// полной репликации: файл делится на K шардов данных и M шардов чётности
+// с помощью кода Рида-Соломона над GF(2^8), каждый шард кладётся на свой
+// узел, а для восстановления файла достаточно любых K шардов из K+M.
+// Накладные расходы на хранение падают с N× (полная репликация на N
+// узлов) до (K+M)/K×, ценой устойчивости лишь к M одновременным отказам.
+
+// ErasureConfig включает режим эразур-кодирования для Node. Если Erasure
+// равен nil или доступных узлов меньше K+M, используется обычная полная
+// репликация чанков (replicateFileFull)
+type ErasureConfig struct {
+	K int // число шардов с данными
+	M int // число шардов чётности
+}
+
+// ShardPlacement хранится в манифесте файла и указывает, на каком узле
+// лежит каждый erasure-шард
+type ShardPlacement struct {
+	K     int      `json:"k"`
+	M     int      `json:"m"`
+	Peers []string `json:"peers"` // Peers[i] — адрес узла с шардом i (как в Peers соседей), "" означает текущий узел
+}
+
+// --- арифметика GF(2^8) ---
+
+const gfExpTableSize = 510
+
+// Неприводимый многочлен x^8 + x^4 + x^3 + x^2 + 1, как в QR-кодах и RS
+const gfPoly = 0x11d
+
+var gfExpTable [gfExpTableSize]byte
+var gfLogTable [256]byte
+
+func init() {
+	x := 1
+	for i := 0; i < 255; i++ {
+		gfExpTable[i] = byte(x)
+		gfLogTable[x] = byte(i)
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= gfPoly
+		}
+	}
+	for i := 255; i < gfExpTableSize; i++ {
+		gfExpTable[i] = gfExpTable[i-255]
+	}
+}
+
+func gfAdd(a, b byte) byte {
+	return a ^ b
+}
+
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExpTable[int(gfLogTable[a])+int(gfLogTable[b])]
+}
+
+func gfDiv(a, b byte) byte {
+	if a == 0 {
+		return 0
+	}
+	logResult := int(gfLogTable[a]) - int(gfLogTable[b])
+	if logResult < 0 {
+		logResult += 255
+	}
+	return gfExpTable[logResult]
+}
+
+// cauchyMatrix строит систематическую кодирующую матрицу размера
+// (K+M)×K: первые K строк — единичная матрица (данные проходят как
+// есть), следующие M строк — матрица Коши. У матрицы Коши любая
+// квадратная подматрица обратима, а значит любых K строк из K+M
+// достаточно, чтобы восстановить исходные данные
+func cauchyMatrix(k, m int) [][]byte {
+	matrix := make([][]byte, k+m)
+	for i := 0; i < k; i++ {
+		row := make([]byte, k)
+		row[i] = 1
+		matrix[i] = row
+	}
+	for i := 0; i < m; i++ {
+		row := make([]byte, k)
+		x := byte(k + i)
+		for j := 0; j < k; j++ {
+			row[j] = gfDiv(1, gfAdd(x, byte(j)))
+		}
+		matrix[k+i] = row
+	}
+	return matrix
+}
+
+// encodeShards вычисляет M шардов чётности для K шардов данных одинакового
+// размера: parity[i] = сумма по j от matrix[k+i][j] * data[j]
+func encodeShards(data [][]byte, m int) ([][]byte, error) {
+	k := len(data)
+	if k == 0 {
+		return nil, fmt.Errorf("нужен хотя бы один шард данных")
+	}
+	shardSize := len(data[0])
+	for _, d := range data {
+		if len(d) != shardSize {
+			return nil, fmt.Errorf("все шарды данных должны быть одного размера")
+		}
+	}
+
+	matrix := cauchyMatrix(k, m)
+	parity := make([][]byte, m)
+	for i := 0; i < m; i++ {
+		row := matrix[k+i]
+		out := make([]byte, shardSize)
+		for j := 0; j < k; j++ {
+			coeff := row[j]
+			if coeff == 0 {
+				continue
+			}
+			for pos := 0; pos < shardSize; pos++ {
+				out[pos] = gfAdd(out[pos], gfMul(coeff, data[j][pos]))
+			}
+		}
+		parity[i] = out
+	}
+	return parity, nil
+}
+
+// reconstructShards восстанавливает K исходных шардов данных по любым K
+// присутствующим шардам (shards[i] == nil, если шарда i нет в наличии)
+func reconstructShards(shards [][]byte, k, m int) ([][]byte, error) {
+	if len(shards) != k+m {
+		return nil, fmt.Errorf("ожидалось %d шардов, получено %d", k+m, len(shards))
+	}
+
+	var present []int
+	shardSize := 0
+	for i, s := range shards {
+		if s == nil {
+			continue
+		}
+		present = append(present, i)
+		if len(s) > shardSize {
+			shardSize = len(s)
+		}
+		if len(present) == k {
+			break
+		}
+	}
+	if len(present) < k {
+		return nil, fmt.Errorf("недостаточно шардов для восстановления: есть %d, нужно %d", len(present), k)
+	}
+
+	matrix := cauchyMatrix(k, m)
+	sub := make([][]byte, k)
+	for idx, shardIdx := range present {
+		sub[idx] = matrix[shardIdx]
+	}
+
+	inverse, err := invertMatrix(sub)
+	if err != nil {
+		return nil, err
+	}
+
+	data := make([][]byte, k)
+	for i := range data {
+		data[i] = make([]byte, shardSize)
+	}
+
+	column := make([]byte, k)
+	for pos := 0; pos < shardSize; pos++ {
+		for idx, shardIdx := range present {
+			column[idx] = shards[shardIdx][pos]
+		}
+		for i := 0; i < k; i++ {
+			var sum byte
+			for j := 0; j < k; j++ {
+				sum = gfAdd(sum, gfMul(inverse[i][j], column[j]))
+			}
+			data[i][pos] = sum
+		}
+	}
+
+	return data, nil
+}
+
+// invertMatrix обращает квадратную матрицу над GF(2^8) методом Гаусса-Жордана
+func invertMatrix(m [][]byte) ([][]byte, error) {
+	n := len(m)
+	aug := make([][]byte, n)
+	for i := range aug {
+		aug[i] = make([]byte, 2*n)
+		copy(aug[i], m[i])
+		aug[i][n+i] = 1
+	}
+
+	for col := 0; col < n; col++ {
+		pivot := -1
+		for row := col; row < n; row++ {
+			if aug[row][col] != 0 {
+				pivot = row
+				break
+			}
+		}
+		if pivot == -1 {
+			return nil, fmt.Errorf("матрица вырождена, восстановление невозможно")
+		}
+		aug[col], aug[pivot] = aug[pivot], aug[col]
+
+		inv := gfDiv(1, aug[col][col])
+		for c := 0; c < 2*n; c++ {
+			aug[col][c] = gfMul(aug[col][c], inv)
+		}
+
+		for row := 0; row < n; row++ {
+			if row == col || aug[row][col] == 0 {
+				continue
+			}
+			factor := aug[row][col]
+			for c := 0; c < 2*n; c++ {
+				aug[row][c] = gfAdd(aug[row][c], gfMul(factor, aug[col][c]))
+			}
+		}
+	}
+
+	inverse := make([][]byte, n)
+	for i := range inverse {
+		inverse[i] = make([]byte, n)
+		copy(inverse[i], aug[i][n:])
+	}
+	return inverse, nil
+}
+
+// splitIntoShards делит содержимое файла на k шардов равного размера,
+// дополняя нулями хвост: последний шард, а при коротком содержимом и
+// несколько последних шардов целиком
+func splitIntoShards(content []byte, k int) [][]byte {
+	shardSize := (len(content) + k - 1) / k
+	if shardSize == 0 {
+		shardSize = 1
+	}
+
+	shards := make([][]byte, k)
+	for i := 0; i < k; i++ {
+		shard := make([]byte, shardSize)
+		start := i * shardSize
+		if start < len(content) {
+			end := start + shardSize
+			if end > len(content) {
+				end = len(content)
+			}
+			copy(shard, content[start:end])
+		}
+		shards[i] = shard
+	}
+	return shards
+}
+
+// --- хранение шардов на диске ---
+
+func (s *Storage) shardsDir(filename string) string {
+	return filepath.Join(s.BaseDir, "shards", filename)
+}
+
+func (s *Storage) shardPath(filename string, index int) string {
+	return filepath.Join(s.shardsDir(filename), strconv.Itoa(index))
+}
+
+// WriteShard сохраняет один erasure-шард файла
+func (s *Storage) WriteShard(filename string, index int, data []byte) error {
+	if err := os.MkdirAll(s.shardsDir(filename), 0755); err != nil {
+		return err
+	}
+	path := s.shardPath(filename, index)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// ReadShard читает один erasure-шард файла
+func (s *Storage) ReadShard(filename string, index int) ([]byte, error) {
+	return os.ReadFile(s.shardPath(filename, index))
+}
+
+// --- интеграция с Node ---
+
+// replicateFileErasure делит файл на K+M erasure-шардов и раскладывает
+// их по одному на узел (первый шард остаётся на этом узле). Вызывается
+// вместо replicateFileFull, когда на Node включён Erasure и узлов
+// достаточно, чтобы разместить все K+M шардов
+func (n *Node) replicateFileErasure(filename string) {
+	k, m := n.Erasure.K, n.Erasure.M
+
+	reader, err := n.Storage.GetFile(filename)
+	if err != nil {
+		log.Printf("❌ Ошибка чтения файла для эразур-кодирования: %v", err)
+		return
+	}
+	content, err := io.ReadAll(reader)
+	reader.Close()
+	if err != nil {
+		log.Printf("❌ Ошибка чтения содержимого файла: %v", err)
+		return
+	}
+
+	dataShards := splitIntoShards(content, k)
+	parityShards, err := encodeShards(dataShards, m)
+	if err != nil {
+		log.Printf("❌ Ошибка эразур-кодирования файла %s: %v", filename, err)
+		return
+	}
+	shards := append(dataShards, parityShards...)
+
+	// holders[i] — узел, которому достанется шард i: шард 0 остаётся
+	// здесь, остальные распределяются по соседям по порядку. Свой шард
+	// записывается под собственным адресом, а не "", чтобы другие узлы,
+	// получившие этот манифест, могли его запросить
+	self := n.selfAddr()
+	holders := append([]string{self}, n.Peers...)
+	placement := ShardPlacement{K: k, M: m, Peers: make([]string, len(shards))}
+
+	for i, shard := range shards {
+		holder := holders[i]
+		placement.Peers[i] = holder
+
+		if holder == self {
+			if err := n.Storage.WriteShard(filename, i, shard); err != nil {
+				log.Printf("❌ Не удалось сохранить шард %d локально: %v", i, err)
+			}
+			continue
+		}
+		if err := n.sendShardToPeer(holder, filename, i, shard); err != nil {
+			log.Printf("⚠️  Не удалось отправить шард %d на %s: %v", i, holder, err)
+		}
+	}
+
+	manifest, err := n.Storage.LoadManifest(filename)
+	if err != nil {
+		log.Printf("⚠️  Не удалось обновить манифест шардов для %s: %v", filename, err)
+		return
+	}
+	manifest.Shards = &placement
+	// Файл теперь хранится как K+M шардов, а не как полный набор чанков —
+	// если оставить ChunkHashes, gossip-синхронизация (см. syncWithPeer в
+	// node.go) продолжит объявлять и докачивать их как обычный файл, и
+	// обещанные (K+M)/K накладные расходы на хранение никогда не
+	// реализуются
+	manifest.ChunkHashes = nil
+	if err := n.Storage.saveManifest(manifest); err != nil {
+		log.Printf("⚠️  Не удалось сохранить манифест шардов для %s: %v", filename, err)
+		return
+	}
+
+	log.Printf("✅ Файл %s реплицирован erasure-кодом (k=%d, m=%d)", filename, k, m)
+}
+
+// canUseErasure сообщает, включён ли erasure-режим и хватает ли узлов
+// (этот + соседи), чтобы разместить все K+M шардов
+func (n *Node) canUseErasure() bool {
+	return n.Erasure != nil && len(n.Peers)+1 >= n.Erasure.K+n.Erasure.M
+}
+
+// sendShardToPeer отправляет один erasure-шард конкретному узлу
+func (n *Node) sendShardToPeer(peerAddr, filename string, index int, data []byte) error {
+	url := fmt.Sprintf("http://%s/shard/%s/%d", peerAddr, filename, index)
+	req, err := http.NewRequest(http.MethodPut, url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("статус ответа: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// fetchShard возвращает шард с заданного узла, а для пустого адреса
+// (текущий узел) читает его напрямую из локального хранилища
+func (n *Node) fetchShard(holder, filename string, index int) ([]byte, error) {
+	if holder == "" {
+		return n.Storage.ReadShard(filename, index)
+	}
+
+	url := fmt.Sprintf("http://%s/shard/%s/%d", holder, filename, index)
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("шард %d не найден на %s", index, holder)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// reconstructErasureFile восстанавливает содержимое файла по любым K из
+// K+M его erasure-шардов, собирая их с узлов из ShardPlacement
+func (n *Node) reconstructErasureFile(manifest Manifest) ([]byte, error) {
+	placement := manifest.Shards
+	total := placement.K + placement.M
+	shards := make([][]byte, total)
+
+	have := 0
+	for i := 0; i < total && have < placement.K; i++ {
+		data, err := n.fetchShard(placement.Peers[i], manifest.Name, i)
+		if err != nil {
+			continue
+		}
+		shards[i] = data
+		have++
+	}
+	if have < placement.K {
+		return nil, fmt.Errorf("доступно только %d из %d необходимых шардов", have, placement.K)
+	}
+
+	dataShards, err := reconstructShards(shards, placement.K, placement.M)
+	if err != nil {
+		return nil, err
+	}
+
+	content := make([]byte, 0, manifest.Size)
+	for _, shard := range dataShards {
+		content = append(content, shard...)
+	}
+	if int64(len(content)) > manifest.Size {
+		content = content[:manifest.Size]
+	}
+	return content, nil
+}
+
+// handleShard обслуживает отдельный erasure-шард: GET отдаёт его,
+// PUT принимает шард от узла, который провёл кодирование
+func (n *Node) handleShard(w http.ResponseWriter, r *http.Request) {
+	filename, index, err := parseShardPath(r.URL.Path)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		data, err := n.Storage.ReadShard(filename, index)
+		if err != nil {
+			http.Error(w, "Шард не найден", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write(data)
+
+	case http.MethodPut:
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "Ошибка чтения тела запроса", http.StatusBadRequest)
+			return
+		}
+		if err := n.Storage.WriteShard(filename, index, data); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+
+	default:
+		http.Error(w, "Метод не поддерживается", http.StatusMethodNotAllowed)
+	}
+}
+
+// parseShardPath разбирает путь вида /shard/<file>/<index>
+func parseShardPath(path string) (filename string, index int, err error) {
+	parts := strings.SplitN(strings.TrimPrefix(path, "/shard/"), "/", 2)
+	if len(parts) != 2 {
+		return "", 0, fmt.Errorf("ожидался путь вида /shard/<file>/<index>")
+	}
+	index, err = strconv.Atoi(parts[1])
+	if err != nil {
+		return "", 0, fmt.Errorf("некорректный индекс шарда")
+	}
+	return parts[0], index, nil
+}
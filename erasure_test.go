@@ -0,0 +1,100 @@
+package main
+
+import "testing"
+
+// TestEncodeReconstructShards проверяет, что содержимое восстанавливается
+// по любым K из K+M шардов после потери до M из них
+func TestEncodeReconstructShards(t *testing.T) {
+	k, m := 4, 2
+
+	data := [][]byte{
+		[]byte("aaaa"),
+		[]byte("bbbb"),
+		[]byte("cccc"),
+		[]byte("dddd"),
+	}
+
+	parity, err := encodeShards(data, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	all := append(append([][]byte(nil), data...), parity...)
+
+	// Теряем два произвольных шарда данных/чётности — остаётся ровно K
+	lossy := make([][]byte, k+m)
+	copy(lossy, all)
+	lossy[1] = nil
+	lossy[k] = nil // первый шард чётности
+
+	recovered, err := reconstructShards(lossy, k, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := range data {
+		if string(recovered[i]) != string(data[i]) {
+			t.Fatalf("шард данных %d восстановлен неверно: получили %q, ожидали %q", i, recovered[i], data[i])
+		}
+	}
+}
+
+// TestReconstructShardsNotEnough проверяет, что при доступности менее K
+// шардов восстановление честно возвращает ошибку, а не повреждённые данные
+func TestReconstructShardsNotEnough(t *testing.T) {
+	k, m := 3, 2
+	data := [][]byte{[]byte("xx"), []byte("yy"), []byte("zz")}
+
+	parity, err := encodeShards(data, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	all := append(append([][]byte(nil), data...), parity...)
+
+	lossy := make([][]byte, k+m)
+	copy(lossy, all)
+	lossy[0] = nil
+	lossy[1] = nil
+	lossy[2] = nil // осталось k-1 = 2 шарда
+
+	if _, err := reconstructShards(lossy, k, m); err == nil {
+		t.Fatal("ожидали ошибку восстановления при нехватке шардов, получили nil")
+	}
+}
+
+// TestInvertMatrix проверяет, что invertMatrix действительно даёт обратную
+// матрицу: произведение с исходной матрицей — единичная
+func TestInvertMatrix(t *testing.T) {
+	m := cauchyMatrix(3, 2)
+	sub := m[:3] // квадратная 3x3 подматрица (первые K строк — единичная, тривиальна, возьмём смесь)
+	sub = [][]byte{m[0], m[3], m[4]}
+
+	inv, err := invertMatrix(sub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	product := make([][]byte, 3)
+	for i := 0; i < 3; i++ {
+		product[i] = make([]byte, 3)
+		for j := 0; j < 3; j++ {
+			var sum byte
+			for l := 0; l < 3; l++ {
+				sum = gfAdd(sum, gfMul(sub[i][l], inv[l][j]))
+			}
+			product[i][j] = sum
+		}
+	}
+
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			want := byte(0)
+			if i == j {
+				want = 1
+			}
+			if product[i][j] != want {
+				t.Fatalf("произведение матрицы на обратную не единичное в (%d,%d): получили %d, ожидали %d", i, j, product[i][j], want)
+			}
+		}
+	}
+}
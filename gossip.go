@@ -0,0 +1,65 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"time"
+)
+
+// Этот файл определяет версионирование файлов для gossip-обмена между
+// узлами: вместо простого объединения множества имён (как раньше в
+// syncWithPeers) каждая запись несёт Lamport-таймстамп и ID узла, что
+// позволяет узнавать обновления и удаления файлов, а не только их
+// появление, и детерминированно разрешать конкурентные записи (LWW).
+
+// DefaultTombstoneGracePeriod — как долго запись об удалении файла
+// хранится на диске после DELETE, прежде чем её можно будет вычистить.
+// За это время она должна успеть разойтись по gossip-обмену на все узлы
+const DefaultTombstoneGracePeriod = 24 * time.Hour
+
+// Version — Lamport-таймстамп плюс ID узла, который его выставил. Две
+// версии одного файла сравниваются по Lamport, а при совпадении —
+// по ID узла, что даёт полный порядок без необходимости в полноценном
+// vector clock по всем узлам кластера
+type Version struct {
+	Lamport int64  `json:"lamport"`
+	NodeID  string `json:"node_id"`
+}
+
+// after сообщает, что v считается строго более новой версией, чем other.
+// Используется и для разрешения конкурентных записей (last-writer-wins),
+// и для решения, перекачивать ли файл у соседа при gossip-обмене
+func (v Version) after(other Version) bool {
+	if v.Lamport != other.Lamport {
+		return v.Lamport > other.Lamport
+	}
+	return v.NodeID > other.NodeID
+}
+
+// handleFileDelete обрабатывает DELETE /files/<name>: вместо немедленного
+// стирания заводит tombstone с новой версией и сразу же рассылает его
+// соседям, не дожидаясь следующего раунда gossip
+func (n *Node) handleFileDelete(w http.ResponseWriter, filename string) {
+	manifest, err := n.Storage.DeleteFile(filename, time.Now())
+	if err != nil {
+		http.Error(w, "Ошибка удаления файла", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("🗑  Файл удалён: %s", filename)
+	go n.propagateTombstone(manifest)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// propagateTombstone рассылает манифест-tombstone всем соседям, переиспользуя
+// тот же /sync/manifest, которым обмениваются чанки при репликации
+func (n *Node) propagateTombstone(manifest Manifest) {
+	for _, peer := range n.Peers {
+		go func(peerAddr string) {
+			if _, err := n.negotiateMissingChunks(peerAddr, manifest); err != nil {
+				log.Printf("⚠️  Не удалось разослать tombstone на %s: %v", peerAddr, err)
+			}
+		}(peer)
+	}
+}
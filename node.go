@@ -2,24 +2,34 @@ package main
 
 import (
 	"bytes"
+	crand "crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
 	"log"
-	"mime/multipart"
+	mrand "math/rand"
 	"net/http"
 	"path/filepath"
+	"strconv"
 	"sync"
 	"time"
 )
 
 // Node представляет собой узел распределённой системы
 type Node struct {
-	Port       string        // Порт, на котором слушает узел
-	Peers      []string      // Список адресов других узлов
-	StorageDir string        // Директория для хранения файлов
-	Storage    *Storage      // Менеджер локального хранилища
-	mu         sync.RWMutex  // Мьютекс для потокобезопасности
+	Port       string         // Порт, на котором слушает узел
+	Peers      []string       // Список адресов других узлов
+	StorageDir string         // Директория для хранения файлов
+	Storage    *Storage       // Менеджер локального хранилища
+	Erasure    *ErasureConfig // Параметры erasure-кодирования (nil — полная репликация)
+	ID         string         // Уникальный ID узла, используется как tie-break в Version
+	mu         sync.RWMutex   // Мьютекс для потокобезопасности
+
+	aliveMu sync.RWMutex    // Мьютекс для alive
+	alive   map[string]bool // Мнение этого узла о живости каждого соседа (см. ring.go)
+
+	Scanners []Scanner // Проверки содержимого перед сохранением загрузки (см. scan.go)
 }
 
 // FileInfo содержит метаданные о файле
@@ -28,27 +38,69 @@ type FileInfo struct {
 	Size int64  `json:"size"`
 }
 
-// NewNode создаёт новый экземпляр узла
-func NewNode(port string, peers []string, storageDir string) *Node {
-	return &Node{
+// GossipFanout — сколько случайных соседей опрашивается за один раунд
+// gossip-синхронизации вместо всех сразу
+const GossipFanout = 3
+
+// NewNode создаёт новый экземпляр узла. Необязательные возможности вроде
+// сканеров содержимого подключаются через opts (см. WithScanners в scan.go),
+// чтобы не раздувать сигнатуру под каждую новую зависимость
+func NewNode(port string, peers []string, storageDir string, opts ...NodeOption) *Node {
+	id, err := randomNodeID()
+	if err != nil {
+		// Не удалось получить случайный ID — используем порт, этого
+		// достаточно, пока на одном хосте не запущено два узла на нём
+		id = port
+	}
+
+	alive := make(map[string]bool, len(peers))
+	for _, peer := range peers {
+		// Оптимистично считаем всех соседей живыми, пока checkMembership
+		// не скажет обратное — так кластер сразу начинает с полным составом
+		alive[peer] = true
+	}
+
+	n := &Node{
 		Port:       port,
 		Peers:      peers,
 		StorageDir: storageDir,
-		Storage:    NewStorage(storageDir),
+		ID:         id,
+		Storage:    NewStorage(storageDir, id),
+		alive:      alive,
 	}
+
+	for _, opt := range opts {
+		opt(n)
+	}
+	return n
+}
+
+// randomNodeID генерирует случайный идентификатор узла
+func randomNodeID() (string, error) {
+	buf := make([]byte, 8)
+	if _, err := crand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
 }
 
 // Start запускает HTTP сервер узла
 func (n *Node) Start() error {
 	// Регистрируем обработчики HTTP-запросов
 	// Каждый обработчик отвечает за свой тип операций
-	
-	http.HandleFunc("/upload", n.handleUpload)       // Загрузка файла
-	http.HandleFunc("/download/", n.handleDownload)  // Скачивание файла
-	http.HandleFunc("/list", n.handleList)           // Список файлов
-	http.HandleFunc("/sync", n.handleSync)           // Синхронизация с другими узлами
-	http.HandleFunc("/health", n.handleHealth)       // Проверка работоспособности
-	
+
+	http.HandleFunc("/upload", n.handleUpload)              // Загрузка файла (multipart, сверх 10 МБ — во временные файлы)
+	http.HandleFunc("/files", n.handleFilesCreate)          // Создание резюмируемой загрузки (tus)
+	http.HandleFunc("/files/", n.handleFilesByID)           // Прогресс/дозапись загрузки, а также удаление файла
+	http.HandleFunc("/download/", n.handleDownload)         // Скачивание файла
+	http.HandleFunc("/list", n.handleList)                  // Список файлов
+	http.HandleFunc("/sync/manifest", n.handleSyncManifest) // Обмен манифестами с соседями
+	http.HandleFunc("/chunk/", n.handleChunk)               // Передача отдельных чанков
+	http.HandleFunc("/shard/", n.handleShard)               // Передача erasure-шардов
+	http.HandleFunc("/where/", n.handleWhere)               // HRW-набор узлов-владельцев файла
+	http.HandleFunc("/evict/", n.handleEvict)               // Локальное удаление файла, из владельцев которого узел выпал
+	http.HandleFunc("/health", n.handleHealth)              // Проверка работоспособности + gossip живости
+
 	// Запускаем фоновую синхронизацию с другими узлами
 	// Это горутина (аналог потока), которая работает параллельно
 	go n.periodicSync()
@@ -83,7 +135,44 @@ func (n *Node) handleUpload(w http.ResponseWriter, r *http.Request) {
 	}
 	defer file.Close()
 
-	// Сохраняем файл локально
+	// По HRW-рейтингу этот файл может принадлежать другому узлу — в этом
+	// случае просто проксируем загрузку на primary, а не сохраняем её здесь
+	if !n.ownsFile(header.Filename) {
+		primary := n.ReplicaSet(header.Filename)[0]
+		if err := n.proxyUpload(primary, header.Filename, file); err != nil {
+			http.Error(w, fmt.Sprintf("Ошибка проксирования загрузки на %s: %v", primary, err), http.StatusBadGateway)
+			return
+		}
+
+		log.Printf("↪️  Файл %s не наш по HRW, проксирован на %s", header.Filename, primary)
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]string{
+			"message": "Файл проксирован на узел-владелец",
+			"file":    header.Filename,
+		})
+		return
+	}
+
+	// Перед сохранением прогоняем файл через настроенные сканеры содержимого
+	// (см. scan.go). Они читают файл независимо от file через header.Open(),
+	// так что позиция чтения file ниже не затрагивается
+	if len(n.Scanners) > 0 {
+		clean, detail, err := n.runScanners(header.Filename, func() (io.ReadCloser, error) {
+			return header.Open()
+		})
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Ошибка проверки файла: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if !clean {
+			n.auditLog(header.Filename, detail)
+			log.Printf("🚫 Загрузка отклонена сканером: %s (%s)", header.Filename, detail)
+			http.Error(w, fmt.Sprintf("Файл отклонён проверкой безопасности: %s", detail), http.StatusUnprocessableEntity)
+			return
+		}
+	}
+
+	// Сохраняем файл локально. Storage сам разобьёт его на чанки
 	err = n.Storage.SaveFile(header.Filename, file)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Ошибка сохранения файла: %v", err), http.StatusInternalServerError)
@@ -104,41 +193,68 @@ func (n *Node) handleUpload(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
-// handleDownload обрабатывает скачивание файла клиентом
+// handleDownload обрабатывает скачивание файла клиентом. Для обычного
+// локального файла используется http.ServeContent — он сам разберётся с
+// Range, If-Modified-Since и определением Content-Type по содержимому,
+// читая файл через Seek, а не загружая его целиком в память. Erasure-
+// кодированный файл (manifest.Shards != nil) так не отдать — у него нет
+// ChunkHashes для чтения по чанкам, поэтому он реконструируется из шардов
+// через serveErasureFile, как и при скачивании у другого узла (см.
+// streamFileFromPeers). Флаг ?download=1 переключает Content-Disposition
+// на attachment вместо показа прямо в браузере
 func (n *Node) handleDownload(w http.ResponseWriter, r *http.Request) {
 	// Извлекаем имя файла из URL
 	// Например, для /download/test.txt получим "test.txt"
 	filename := filepath.Base(r.URL.Path)
+	download := r.URL.Query().Get("download") == "1"
+
+	manifest, err := n.Storage.LoadManifest(filename)
+	if err == nil && !manifest.Deleted {
+		complete := true
+		for _, hash := range manifest.ChunkHashes {
+			if !n.Storage.HasChunk(hash) {
+				complete = false
+				break
+			}
+		}
 
-	// Пытаемся открыть файл локально
-	file, err := n.Storage.GetFile(filename)
-	if err != nil {
-		// Если файла нет локально, пытаемся найти его на других узлах
-		log.Printf("Файл %s не найден локально, запрашиваем у соседей", filename)
-		
-		content, err := n.fetchFileFromPeers(filename)
-		if err != nil {
-			http.Error(w, "Файл не найден", http.StatusNotFound)
+		if manifest.Shards != nil {
+			if n.serveErasureFile(w, manifest, download) {
+				return
+			}
+		} else if !complete {
+			// Манифест уже есть, но чанки ещё не докачаны — идём к соседям
+		} else if file, ferr := n.Storage.GetFile(filename); ferr == nil {
+			defer file.Close()
+
+			setDownloadHeaders(w, filename, manifest.MerkleRoot, download)
+			http.ServeContent(w, r, filename, time.Unix(manifest.ModTime, 0), file)
+
+			log.Printf("📤 Файл отправлен: %s", filename)
 			return
 		}
-		
-		// Сохраняем полученный файл локально для будущих запросов
-		n.Storage.SaveFile(filename, bytes.NewReader(content))
-		
-		// Отправляем файл клиенту
-		w.Header().Set("Content-Disposition", "attachment; filename="+filename)
-		w.Header().Set("Content-Type", "application/octet-stream")
-		w.Write(content)
-		return
 	}
-	defer file.Close()
 
-	// Отправляем файл клиенту
-	w.Header().Set("Content-Disposition", "attachment; filename="+filename)
-	w.Header().Set("Content-Type", "application/octet-stream")
-	io.Copy(w, file)
-	
-	log.Printf("📤 Файл отправлен: %s", filename)
+	// Манифеста нет локально (или он есть, но чанков/шардов не хватает) —
+	// пытаемся найти файл на одном из узлов, которые должны им владеть
+	// по HRW-рейтингу
+	if !n.streamFileFromPeers(w, r, filename, download) {
+		http.Error(w, "Файл не найден", http.StatusNotFound)
+	}
+}
+
+// setDownloadHeaders выставляет ETag (по корню Меркла файла — он меняется
+// при любом изменении содержимого) и Content-Disposition, переключаемый
+// флагом download между показом в браузере и принудительным скачиванием
+func setDownloadHeaders(w http.ResponseWriter, filename, contentHash string, download bool) {
+	if contentHash != "" {
+		w.Header().Set("ETag", `"`+contentHash+`"`)
+	}
+	if download {
+		w.Header().Set("Content-Disposition", "attachment; filename="+filename)
+	} else {
+		w.Header().Set("Content-Disposition", "inline; filename="+filename)
+	}
 }
 
 // handleList возвращает список всех файлов в системе
@@ -153,83 +269,174 @@ func (n *Node) handleList(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(files)
 }
 
-// handleSync обрабатывает запрос на синхронизацию от другого узла
-func (n *Node) handleSync(w http.ResponseWriter, r *http.Request) {
-	if r.Method == http.MethodGet {
-		// Возвращаем список наших файлов
-		files, err := n.Storage.ListFiles()
+// handleSyncManifest обслуживает обмен манифестами между узлами:
+// GET отдаёт манифесты всех локальных файлов (имя, хэши чанков, корень
+// Меркла), POST принимает манифест от соседа и отвечает, каких чанков
+// этого файла у нас ещё нет
+func (n *Node) handleSyncManifest(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		manifests, err := n.Storage.AllManifests()
 		if err != nil {
-			http.Error(w, "Ошибка получения списка", http.StatusInternalServerError)
+			http.Error(w, "Ошибка получения манифестов", http.StatusInternalServerError)
 			return
 		}
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(files)
-	} else if r.Method == http.MethodPost {
-		// Получаем файл от другого узла
-		n.handleUpload(w, r)
+		json.NewEncoder(w).Encode(manifests)
+
+	case http.MethodPost:
+		var manifest Manifest
+		if err := json.NewDecoder(r.Body).Decode(&manifest); err != nil {
+			http.Error(w, "Некорректный манифест", http.StatusBadRequest)
+			return
+		}
+
+		var missing []string
+		for _, hash := range manifest.ChunkHashes {
+			if !n.Storage.HasChunk(hash) {
+				missing = append(missing, hash)
+			}
+		}
+
+		n.Storage.witnessVersion(manifest.Version)
+		if local, err := n.Storage.LoadManifest(manifest.Name); err != nil || manifest.Version.after(local.Version) {
+			if err := n.Storage.saveManifest(manifest); err != nil {
+				log.Printf("⚠️  Не удалось сохранить манифест %s: %v", manifest.Name, err)
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string][]string{"missing_chunks": missing})
+
+	default:
+		http.Error(w, "Метод не поддерживается", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleChunk отдаёт (GET) или принимает (POST) один чанк по его хэшу
+func (n *Node) handleChunk(w http.ResponseWriter, r *http.Request) {
+	hash := filepath.Base(r.URL.Path)
+
+	switch r.Method {
+	case http.MethodGet:
+		data, err := n.Storage.ReadChunk(hash)
+		if err != nil {
+			http.Error(w, "Чанк не найден", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write(data)
+
+	case http.MethodPost:
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "Ошибка чтения тела запроса", http.StatusBadRequest)
+			return
+		}
+		if err := n.Storage.WriteChunk(hash, data); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+
+	default:
+		http.Error(w, "Метод не поддерживается", http.StatusMethodNotAllowed)
 	}
 }
 
-// handleHealth проверяет, работает ли узел
+// handleHealth проверяет, работает ли узел, и заодно делится с соседом
+// своим мнением о живости остальных узлов (см. healthStatus в ring.go)
 func (n *Node) handleHealth(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]string{"status": "healthy"})
+	json.NewEncoder(w).Encode(healthStatus{Status: "healthy", Alive: n.aliveSnapshot()})
 }
 
-// replicateFile отправляет файл на все остальные узлы
+// replicateFile реплицирует только что сохранённый файл на другие узлы.
+// Если на Node включён Erasure и соседей достаточно, чтобы разместить
+// все K+M шардов, используется erasure-кодирование; иначе — полная
+// репликация чанков
 func (n *Node) replicateFile(filename string) {
-	file, err := n.Storage.GetFile(filename)
+	if n.canUseErasure() {
+		n.replicateFileErasure(filename)
+		return
+	}
+	n.replicateFileFull(filename)
+}
+
+// replicateFileFull реплицирует манифест и недостающие чанки файла на
+// остальных владельцев файла по HRW-рейтингу, перекачивая только то, чего у соседа ещё нет. Так как
+// передача идёт по чанкам, прерванная на середине репликация не требует
+// перезапуска: при следующей попытке negotiateMissingChunks снова
+// согласует уже переданные чанки как имеющиеся и докачает только остаток
+func (n *Node) replicateFileFull(filename string) {
+	manifest, err := n.Storage.LoadManifest(filename)
 	if err != nil {
-		log.Printf("❌ Ошибка чтения файла для репликации: %v", err)
+		log.Printf("❌ Ошибка чтения манифеста для репликации: %v", err)
 		return
 	}
-	defer file.Close()
 
-	// Читаем содержимое файла в память
-	content, err := io.ReadAll(file)
+	// Реплицируем не на всех соседей, а только на остальных владельцев
+	// файла по HRW-рейтингу — так нагрузка на хранилище не растёт с
+	// числом узлов в кластере
+	for _, peer := range n.replicaPeers(filename) {
+		go n.replicateToPeer(peer, manifest)
+	}
+}
+
+// replicateToPeer выясняет у соседа, каких чанков манифеста ему не хватает,
+// и отправляет только их
+func (n *Node) replicateToPeer(peerAddr string, manifest Manifest) {
+	missing, err := n.negotiateMissingChunks(peerAddr, manifest)
 	if err != nil {
-		log.Printf("❌ Ошибка чтения содержимого файла: %v", err)
+		log.Printf("⚠️  Не удалось согласовать чанки с %s: %v", peerAddr, err)
 		return
 	}
 
-	// Отправляем файл на каждый узел из списка соседей
-	for _, peer := range n.Peers {
-		go func(peerAddr string) {
-			err := n.sendFileToPeer(peerAddr, filename, content)
-			if err != nil {
-				log.Printf("⚠️  Не удалось реплицировать на %s: %v", peerAddr, err)
-			} else {
-				log.Printf("✅ Файл реплицирован на %s", peerAddr)
-			}
-		}(peer)
+	for _, hash := range missing {
+		data, err := n.Storage.ReadChunk(hash)
+		if err != nil {
+			log.Printf("❌ Чанк %s отсутствует локально: %v", hash, err)
+			return
+		}
+		if err := n.sendChunkToPeer(peerAddr, hash, data); err != nil {
+			log.Printf("⚠️  Не удалось реплицировать чанк %s на %s: %v", hash, peerAddr, err)
+			return
+		}
 	}
+
+	log.Printf("✅ Файл %s реплицирован на %s (%d новых чанков)", manifest.Name, peerAddr, len(missing))
 }
 
-// sendFileToPeer отправляет файл конкретному узлу
-func (n *Node) sendFileToPeer(peerAddr, filename string, content []byte) error {
-	// Создаём multipart форму для отправки файла
-	body := &bytes.Buffer{}
-	writer := multipart.NewWriter(body)
-	
-	part, err := writer.CreateFormFile("file", filename)
+// negotiateMissingChunks отправляет соседу манифест файла и получает
+// в ответ список хэшей чанков, которых у него ещё нет
+func (n *Node) negotiateMissingChunks(peerAddr string, manifest Manifest) ([]string, error) {
+	body, err := json.Marshal(manifest)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	
-	part.Write(content)
-	writer.Close()
 
-	// Отправляем POST запрос
-	url := fmt.Sprintf("http://%s/sync", peerAddr)
-	req, err := http.NewRequest("POST", url, body)
+	url := fmt.Sprintf("http://%s/sync/manifest", peerAddr)
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
 	if err != nil {
-		return err
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		MissingChunks []string `json:"missing_chunks"`
 	}
-	
-	req.Header.Set("Content-Type", writer.FormDataContentType())
-	
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	return result.MissingChunks, nil
+}
+
+// sendChunkToPeer отправляет один чанк конкретному узлу
+func (n *Node) sendChunkToPeer(peerAddr, hash string, data []byte) error {
+	url := fmt.Sprintf("http://%s/chunk/%s", peerAddr, hash)
 	client := &http.Client{Timeout: 10 * time.Second}
-	resp, err := client.Do(req)
+	resp, err := client.Post(url, "application/octet-stream", bytes.NewReader(data))
 	if err != nil {
 		return err
 	}
@@ -238,80 +445,245 @@ func (n *Node) sendFileToPeer(peerAddr, filename string, content []byte) error {
 	if resp.StatusCode != http.StatusOK {
 		return fmt.Errorf("статус ответа: %d", resp.StatusCode)
 	}
-
 	return nil
 }
 
-// fetchFileFromPeers пытается получить файл от других узлов
-func (n *Node) fetchFileFromPeers(filename string) ([]byte, error) {
-	for _, peer := range n.Peers {
-		url := fmt.Sprintf("http://%s/download/%s", peer, filename)
-		
-		client := &http.Client{Timeout: 10 * time.Second}
+// fetchChunkFromPeer запрашивает один чанк у конкретного узла
+func (n *Node) fetchChunkFromPeer(peerAddr, hash string) ([]byte, error) {
+	url := fmt.Sprintf("http://%s/chunk/%s", peerAddr, hash)
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("чанк %s не найден на %s", hash, peerAddr)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// fetchManifestFromPeers ищет манифест файла среди узлов, которые по
+// HRW-рейтингу должны им владеть, и возвращает манифест вместе с адресом
+// узла, который им поделился — вместо того чтобы вслепую перебирать всех
+// n.Peers, мы сразу знаем, у кого спрашивать
+func (n *Node) fetchManifestFromPeers(filename string) (Manifest, string, error) {
+	for _, peer := range n.replicaPeers(filename) {
+		url := fmt.Sprintf("http://%s/sync/manifest", peer)
+		client := &http.Client{Timeout: 5 * time.Second}
+
 		resp, err := client.Get(url)
 		if err != nil {
 			continue
 		}
-		defer resp.Body.Close()
 
-		if resp.StatusCode == http.StatusOK {
-			return io.ReadAll(resp.Body)
+		var manifests map[string]Manifest
+		err = json.NewDecoder(resp.Body).Decode(&manifests)
+		resp.Body.Close()
+		if err != nil {
+			continue
+		}
+
+		if m, ok := manifests[filename]; ok {
+			return m, peer, nil
 		}
 	}
-	
-	return nil, fmt.Errorf("файл не найден ни на одном узле")
+
+	return Manifest{}, "", fmt.Errorf("файл %s не найден ни на одном узле", filename)
 }
 
-// periodicSync периодически синхронизируется с другими узлами
+// streamFileFromPeers находит манифест файла у соседей и отдаёт его
+// клиенту: файлы с erasure-шардами восстанавливаются по любым K из K+M
+// шардов, а обычные файлы не докачиваются на этот узел вовсе — запрос
+// целиком проксируется на владельца и льётся клиенту через io.Copy, без
+// буферизации содержимого здесь (этот узел всё равно не входит в набор
+// реплик файла, так что кэшировать его тут незачем, см. ring.go)
+func (n *Node) streamFileFromPeers(w http.ResponseWriter, r *http.Request, filename string, download bool) bool {
+	manifest, peerAddr, err := n.fetchManifestFromPeers(filename)
+	if err != nil {
+		return false
+	}
+
+	log.Printf("Файл %s не найден локально, запрашиваем у %s", filename, peerAddr)
+
+	if manifest.Shards != nil {
+		return n.serveErasureFile(w, manifest, download)
+	}
+
+	return n.proxyDownload(w, r, peerAddr, filename)
+}
+
+// proxyDownload пересылает запрос на скачивание файла узлу peerAddr,
+// прокидывая заголовок Range (чтобы частичные запросы продолжали работать
+// через проксирующий узел), и льёт ответ клиенту через io.Copy
+func (n *Node) proxyDownload(w http.ResponseWriter, r *http.Request, peerAddr, filename string) bool {
+	url := fmt.Sprintf("http://%s/download/%s", peerAddr, filename)
+	if r.URL.RawQuery != "" {
+		url += "?" + r.URL.RawQuery
+	}
+
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return false
+	}
+	if rng := r.Header.Get("Range"); rng != "" {
+		req.Header.Set("Range", rng)
+	}
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Printf("❌ Не удалось проксировать скачивание %s с %s: %v", filename, peerAddr, err)
+		return false
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		return false
+	}
+
+	for _, header := range []string{"Content-Type", "Content-Length", "Content-Range", "Accept-Ranges", "ETag", "Content-Disposition"} {
+		if v := resp.Header.Get(header); v != "" {
+			w.Header().Set(header, v)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+
+	log.Printf("📥 Файл %s проксирован клиенту от %s", filename, peerAddr)
+	return true
+}
+
+// serveErasureFile восстанавливает файл по его erasure-шардам и отдаёт
+// восстановленное содержимое клиенту, заодно сохраняя его локально
+func (n *Node) serveErasureFile(w http.ResponseWriter, manifest Manifest, download bool) bool {
+	content, err := n.reconstructErasureFile(manifest)
+	if err != nil {
+		log.Printf("❌ Не удалось восстановить файл %s по erasure-шардам: %v", manifest.Name, err)
+		return false
+	}
+
+	if err := n.Storage.CacheFile(manifest, bytes.NewReader(content)); err != nil {
+		log.Printf("⚠️  Не удалось сохранить восстановленный файл %s: %v", manifest.Name, err)
+	}
+
+	setDownloadHeaders(w, manifest.Name, manifest.MerkleRoot, download)
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+	w.Write(content)
+
+	log.Printf("📥 Файл %s восстановлен из erasure-шардов и отправлен", manifest.Name)
+	return true
+}
+
+// periodicSync периодически проверяет живость соседей, проводит раунд
+// gossip-синхронизации и вычищает просроченные tombstone
 func (n *Node) periodicSync() {
 	// Ждём 5 секунд перед первой синхронизацией
 	time.Sleep(5 * time.Second)
-	
+
 	// Создаём тикер, который срабатывает каждые 30 секунд
 	ticker := time.NewTicker(30 * time.Second)
 	defer ticker.Stop()
 
 	for range ticker.C {
+		n.checkMembership()
 		n.syncWithPeers()
+		if err := n.Storage.PurgeExpiredTombstones(time.Now()); err != nil {
+			log.Printf("⚠️  Ошибка очистки просроченных tombstone: %v", err)
+		}
 	}
 }
 
-// syncWithPeers синхронизирует файлы со всеми соседними узлами
+// syncWithPeers проводит один раунд gossip-синхронизации со случайным
+// подмножеством соседей вместо опроса всех сразу — так нагрузка на сеть
+// не растёт линейно с числом узлов в кластере
 func (n *Node) syncWithPeers() {
-	for _, peer := range n.Peers {
-		go func(peerAddr string) {
-			// Получаем список файлов с соседнего узла
-			url := fmt.Sprintf("http://%s/sync", peerAddr)
-			client := &http.Client{Timeout: 5 * time.Second}
-			
-			resp, err := client.Get(url)
-			if err != nil {
-				return
-			}
-			defer resp.Body.Close()
+	for _, peer := range n.randomPeerSubset(GossipFanout) {
+		go n.syncWithPeer(peer)
+	}
+}
 
-			var peerFiles []FileInfo
-			if err := json.NewDecoder(resp.Body).Decode(&peerFiles); err != nil {
-				return
-			}
+// randomPeerSubset возвращает до count случайных адресов из n.Peers
+func (n *Node) randomPeerSubset(count int) []string {
+	if count >= len(n.Peers) {
+		return n.Peers
+	}
 
-			// Проверяем, каких файлов у нас нет
-			localFiles, _ := n.Storage.ListFiles()
-			localFileMap := make(map[string]bool)
-			for _, f := range localFiles {
-				localFileMap[f.Name] = true
-			}
+	shuffled := append([]string(nil), n.Peers...)
+	mrand.Shuffle(len(shuffled), func(i, j int) {
+		shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+	})
+	return shuffled[:count]
+}
+
+// syncWithPeer обменивается с одним соседом тройками (имя, версия,
+// удалён ли файл) и применяет то, что у соседа строго новее и при этом
+// принадлежит этому узлу по HRW-рейтингу: скачивает недостающие чанки
+// обновлённых файлов либо накладывает tombstone для удалённых, используя
+// last-writer-wins на случай конкурентных правок
+func (n *Node) syncWithPeer(peerAddr string) {
+	url := fmt.Sprintf("http://%s/sync/manifest", peerAddr)
+	client := &http.Client{Timeout: 5 * time.Second}
+
+	resp, err := client.Get(url)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	var peerManifests map[string]Manifest
+	if err := json.NewDecoder(resp.Body).Decode(&peerManifests); err != nil {
+		return
+	}
+
+	localManifests, _ := n.Storage.AllManifests()
+
+	for name, peerManifest := range peerManifests {
+		if !n.ownsFile(name) {
+			continue // по HRW-рейтингу этот файл не наш — нам незачем его тянуть
+		}
+
+		local, known := localManifests[name]
+		if known && !peerManifest.Version.after(local.Version) {
+			continue // наша версия не старше версии соседа — нечего применять
+		}
+
+		n.Storage.witnessVersion(peerManifest.Version)
 
-			// Запрашиваем недостающие файлы
-			for _, peerFile := range peerFiles {
-				if !localFileMap[peerFile.Name] {
-					content, err := n.fetchFileFromPeers(peerFile.Name)
-					if err == nil {
-						n.Storage.SaveFile(peerFile.Name, bytes.NewReader(content))
-						log.Printf("🔄 Синхронизирован файл: %s", peerFile.Name)
-					}
+		if err := n.Storage.saveManifest(peerManifest); err != nil {
+			log.Printf("⚠️  Не удалось сохранить манифест %s: %v", name, err)
+			continue
+		}
+
+		if peerManifest.Deleted {
+			log.Printf("🗑  Применён tombstone от %s: %s", peerAddr, name)
+			continue
+		}
+
+		// Erasure-кодированные файлы синхронизируются через свои шарды
+		// (см. replicateFileErasure в erasure.go), а не через обычные
+		// чанки — их манифест не несёт ChunkHashes, но раз уж соседи могли
+		// остаться со старым манифестом, явно пропускаем докачку чанков
+		// для любого манифеста с Shards, а не полагаемся только на пустой
+		// ChunkHashes
+		if peerManifest.Shards == nil {
+			for _, hash := range peerManifest.ChunkHashes {
+				if n.Storage.HasChunk(hash) {
+					continue
+				}
+				data, err := n.fetchChunkFromPeer(peerAddr, hash)
+				if err != nil {
+					log.Printf("⚠️  Не удалось получить чанк %s от %s: %v", hash, peerAddr, err)
+					continue
+				}
+				if err := n.Storage.WriteChunk(hash, data); err != nil {
+					log.Printf("⚠️  Чанк %s повреждён: %v", hash, err)
 				}
 			}
-		}(peer)
+		}
+
+		log.Printf("🔄 Синхронизирован файл: %s", name)
 	}
-}
\ No newline at end of file
+}
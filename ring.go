@@ -0,0 +1,362 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// Этот файл заменяет полную репликацию «на всех соседей» размещением по
+// rendezvous-хэшированию (HRW): для имени файла каждый узел кластера
+// независимо вычисляет один и тот же вес hash(адрес || имя файла) и
+// выбирает ReplicationFactor узлов с наибольшим весом как владельцев
+// файла. В отличие от хэширования по модулю N, при добавлении или потере
+// узла меняется набор владельцев лишь у O(1/N) файлов, а не почти у всех —
+// это и есть весь смысл HRW по сравнению с mod-N.
+
+// ReplicationFactor — сколько узлов из HRW-рейтинга хранят полную копию файла
+const ReplicationFactor = 3
+
+// selfAddr возвращает адрес этого узла в том виде, в каком его перечисляют
+// в Peers соседи — так HRW-рейтинг получается одинаковым на всех узлах
+func (n *Node) selfAddr() string {
+	return "localhost:" + n.Port
+}
+
+// rendezvousWeight — вес узла addr для файла filename по алгоритму HRW
+// (highest random weight): первые 8 байт SHA-256 от "адрес|имя файла"
+// трактуются как число; узел с наибольшим весом — основной владелец файла
+func rendezvousWeight(addr, filename string) uint64 {
+	sum := sha256.Sum256([]byte(addr + "|" + filename))
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+// replicaSetFor вычисляет набор владельцев файла filename среди members,
+// упорядоченный по убыванию HRW-веса (первый элемент результата — primary). Вынесена из
+// Node.ReplicaSet, чтобы ребалансировка могла сравнить набор владельцев до
+// и после изменения состава кластера, не трогая текущий n.Peers
+func replicaSetFor(filename string, members []string) []string {
+	ranked := append([]string(nil), members...)
+	sort.Slice(ranked, func(i, j int) bool {
+		return rendezvousWeight(ranked[i], filename) > rendezvousWeight(ranked[j], filename)
+	})
+
+	if len(ranked) > ReplicationFactor {
+		ranked = ranked[:ReplicationFactor]
+	}
+	return ranked
+}
+
+// ReplicaSet возвращает адреса узлов, которые должны хранить файл filename,
+// упорядоченные по убыванию HRW-веса, среди узлов, которые этот узел сейчас
+// считает живыми
+func (n *Node) ReplicaSet(filename string) []string {
+	return replicaSetFor(filename, n.aliveMembers())
+}
+
+// replicaPeers — то же самое, что ReplicaSet, но без самого узла: именно
+// этот список соседей нужно опрашивать при репликации и при поиске файла,
+// а не перебирать весь n.Peers
+func (n *Node) replicaPeers(filename string) []string {
+	var peers []string
+	for _, addr := range n.ReplicaSet(filename) {
+		if addr != n.selfAddr() {
+			peers = append(peers, addr)
+		}
+	}
+	return peers
+}
+
+// ownsFile сообщает, входит ли этот узел в набор реплик файла filename
+func (n *Node) ownsFile(filename string) bool {
+	for _, addr := range n.ReplicaSet(filename) {
+		if addr == n.selfAddr() {
+			return true
+		}
+	}
+	return false
+}
+
+// handleWhere обрабатывает GET /where/<name>: отдаёт упорядоченный список
+// узлов-владельцев файла, чтобы клиент мог сразу обратиться к primary,
+// не гадая и не дожидаясь проксирования через случайный узел
+func (n *Node) handleWhere(w http.ResponseWriter, r *http.Request) {
+	filename := filepath.Base(r.URL.Path)
+	replicas := n.ReplicaSet(filename)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"file":     filename,
+		"replicas": replicas,
+		"primary":  replicas[0],
+	})
+}
+
+// proxyUpload пересылает содержимое файла на узел peerAddr через его
+// собственный /upload — используется, когда загрузка пришла на узел,
+// который по HRW не входит в набор владельцев файла
+func (n *Node) proxyUpload(peerAddr, filename string, content io.Reader) error {
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	part, err := writer.CreateFormFile("file", filename)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(part, content); err != nil {
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+
+	url := fmt.Sprintf("http://%s/upload", peerAddr)
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Post(url, writer.FormDataContentType(), &body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("статус ответа: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// --- учёт живости соседей и ребалансировка при изменении состава кластера ---
+
+// healthStatus — тело ответа GET /health. Помимо статуса самого узла несёт
+// его текущее мнение о живости соседей: опрашивая /health, узел заодно
+// перенимает чужие наблюдения о третьих узлах, и изменение состава
+// кластера распространяется быстрее, чем одними прямыми опросами —
+// лёгкий аналог peer-list gossip без отдельного протокола и сообщений
+type healthStatus struct {
+	Status string          `json:"status"`
+	Alive  map[string]bool `json:"alive"`
+}
+
+// aliveMembers возвращает адреса всех узлов, которых этот узел сейчас
+// считает живыми, включая себя самого
+func (n *Node) aliveMembers() []string {
+	n.aliveMu.RLock()
+	defer n.aliveMu.RUnlock()
+
+	members := make([]string, 0, len(n.alive)+1)
+	members = append(members, n.selfAddr())
+	for addr, ok := range n.alive {
+		if ok {
+			members = append(members, addr)
+		}
+	}
+	return members
+}
+
+func (n *Node) setAlive(addr string, ok bool) {
+	n.aliveMu.Lock()
+	defer n.aliveMu.Unlock()
+	n.alive[addr] = ok
+}
+
+// adoptAlive принимает чужое мнение о живости addr, только если у нас по
+// этому узлу ещё нет собственного прямого наблюдения — прямой опрос всегда
+// важнее гостившего мнения
+func (n *Node) adoptAlive(addr string, ok bool) {
+	// Прямые наблюдения есть только по настроенным соседям — их опрашивает
+	// pingHealth, а мнение о всех остальных узлах обновляется из gossip
+	for _, peer := range n.Peers {
+		if peer == addr {
+			return
+		}
+	}
+
+	n.aliveMu.Lock()
+	defer n.aliveMu.Unlock()
+	n.alive[addr] = ok
+}
+
+func (n *Node) aliveSnapshot() map[string]bool {
+	n.aliveMu.RLock()
+	defer n.aliveMu.RUnlock()
+
+	snapshot := make(map[string]bool, len(n.alive))
+	for addr, ok := range n.alive {
+		snapshot[addr] = ok
+	}
+	return snapshot
+}
+
+// checkMembership опрашивает /health каждого настроенного соседа, обновляет
+// своё мнение о его живости и, если набор живых узлов изменился с прошлого
+// раунда, запускает ребалансировку затронутых файлов
+func (n *Node) checkMembership() {
+	before := n.aliveMembers()
+
+	for _, peer := range n.Peers {
+		n.pingHealth(peer)
+	}
+
+	after := n.aliveMembers()
+	if sameMembers(before, after) {
+		return
+	}
+
+	log.Printf("👀 Состав живых узлов изменился: %v -> %v", before, after)
+	n.rebalance(before, after)
+}
+
+// pingHealth опрашивает /health одного соседа и обновляет своё мнение о
+// его живости, а заодно перенимает его мнение о третьих узлах
+func (n *Node) pingHealth(peer string) {
+	client := &http.Client{Timeout: 3 * time.Second}
+	resp, err := client.Get(fmt.Sprintf("http://%s/health", peer))
+	if err != nil {
+		n.setAlive(peer, false)
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		n.setAlive(peer, false)
+		return
+	}
+	n.setAlive(peer, true)
+
+	var status healthStatus
+	if json.NewDecoder(resp.Body).Decode(&status) != nil {
+		return
+	}
+	for addr, ok := range status.Alive {
+		if addr != n.selfAddr() {
+			n.adoptAlive(addr, ok)
+		}
+	}
+}
+
+// evictFromPeer просит peerAddr локально убрать файл, владельцем которого
+// он перестал быть по новому HRW-набору — без этого хранилище на каждом
+// узле только росло бы с каждой сменой состава кластера, а не перемещалось
+func (n *Node) evictFromPeer(peerAddr, filename string) error {
+	url := fmt.Sprintf("http://%s/evict/%s", peerAddr, filename)
+	req, err := http.NewRequest(http.MethodDelete, url, nil)
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("статус ответа: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// handleEvict обрабатывает DELETE /evict/<name>: локально убирает манифест
+// файла без tombstone и без рассылки — в отличие от handleFileDelete это не
+// пользовательское удаление, а просто избавление от копии, оставшейся с
+// прошлого HRW-состава, пока остальные владельцы по-прежнему хранят файл
+func (n *Node) handleEvict(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Метод не поддерживается", http.StatusMethodNotAllowed)
+		return
+	}
+
+	filename := filepath.Base(r.URL.Path)
+	if err := n.Storage.RemoveLocalFile(filename); err != nil {
+		http.Error(w, fmt.Sprintf("Ошибка удаления файла: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// rebalance сравнивает набор владельцев каждого локального файла при
+// старом и новом составе кластера и перекачивает только те файлы, чей
+// набор владельцев действительно изменился — O(1/N) файлов при изменении
+// HRW-состава на один узел, а не все файлы разом, как при mod-N хэшировании.
+// Узлы, выпавшие из набора владельцев, освобождаются от своей копии через
+// evictFromPeer, иначе хранилище только бы росло с каждой сменой состава
+func (n *Node) rebalance(oldMembers, newMembers []string) {
+	manifests, err := n.Storage.AllManifests()
+	if err != nil {
+		log.Printf("⚠️  Не удалось получить манифесты для ребалансировки: %v", err)
+		return
+	}
+
+	moved := 0
+	for name, manifest := range manifests {
+		if manifest.Deleted {
+			continue
+		}
+		if manifest.Shards != nil {
+			// Шарды уже разложены по конкретным узлам в ShardPlacement при
+			// кодировании (см. replicateFileErasure в erasure.go), а не по
+			// HRW-набору, так что полные чанки качать здесь нечего и некуда
+			continue
+		}
+
+		oldSet := replicaSetFor(name, oldMembers)
+		newSet := replicaSetFor(name, newMembers)
+		if sameMembers(oldSet, newSet) {
+			continue
+		}
+
+		moved++
+		for _, addr := range newSet {
+			if addr != n.selfAddr() {
+				go n.replicateToPeer(addr, manifest)
+			}
+		}
+		for _, addr := range oldSet {
+			if addr != n.selfAddr() && !sliceContains(newSet, addr) {
+				go n.evictFromPeer(addr, name)
+			}
+		}
+	}
+
+	if moved > 0 {
+		log.Printf("🔀 Состав кластера изменился, переразмещено файлов: %d", moved)
+	}
+}
+
+// sliceContains сообщает, встречается ли addr среди list
+func sliceContains(list []string, addr string) bool {
+	for _, a := range list {
+		if a == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// sameMembers сравнивает два набора адресов без учёта порядка
+func sameMembers(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	seen := make(map[string]int, len(a))
+	for _, addr := range a {
+		seen[addr]++
+	}
+	for _, addr := range b {
+		seen[addr]--
+	}
+	for _, count := range seen {
+		if count != 0 {
+			return false
+		}
+	}
+	return true
+}
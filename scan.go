@@ -0,0 +1,332 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Этот файл добавляет проверку содержимого перед тем, как загруженный файл
+// будет сохранён в Storage и разослан на другие узлы: handleUpload прогоняет
+// его через все настроенные Scanner одновременно и отклоняет загрузку, если
+// хотя бы один из них сообщил о заражении (fail closed — как при отказе
+// самого сканера, так и при обнаружении).
+
+// Scanner проверяет содержимое r и сообщает, чисто ли оно. detail заполняется
+// как при обнаружении (что именно нашли), так и может использоваться для
+// диагностики
+type Scanner interface {
+	Scan(name string, r io.Reader) (clean bool, detail string, err error)
+}
+
+// NodeOption настраивает необязательные возможности Node при создании, не
+// раздувая сигнатуру NewNode под каждую новую опциональную зависимость
+type NodeOption func(*Node)
+
+// WithScanners подключает к узлу один или несколько сканеров содержимого:
+// каждая загрузка, которой владеет этот узел, проверяется всеми ими перед
+// сохранением (см. handleUpload)
+func WithScanners(scanners ...Scanner) NodeOption {
+	return func(n *Node) {
+		n.Scanners = append(n.Scanners, scanners...)
+	}
+}
+
+type scanResult struct {
+	clean  bool
+	detail string
+	err    error
+}
+
+// runScanners прогоняет файл через все настроенные сканеры параллельно,
+// открывая для каждого свой независимый io.Reader через open — так они не
+// мешают друг другу и не задевают тот reader, который вызывающая сторона
+// затем передаст в Storage.SaveFile. open вызывается отдельно на каждый
+// сканер (для multipart-загрузки это header.Open, для резюмируемой —
+// повторное открытие временного файла, см. finalizeTusUpload в upload.go).
+// Если упал хотя бы один сканер или кто-то из них нашёл заражение, итог
+// отрицательный: fail closed, а не в обход
+func (n *Node) runScanners(name string, open func() (io.ReadCloser, error)) (clean bool, detail string, err error) {
+	var wg sync.WaitGroup
+	results := make(chan scanResult, len(n.Scanners))
+
+	for _, scanner := range n.Scanners {
+		wg.Add(1)
+		go func(sc Scanner) {
+			defer wg.Done()
+
+			f, ferr := open()
+			if ferr != nil {
+				results <- scanResult{err: ferr}
+				return
+			}
+			defer f.Close()
+
+			ok, why, serr := sc.Scan(name, f)
+			results <- scanResult{clean: ok, detail: why, err: serr}
+		}(scanner)
+	}
+
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	clean = true
+	for res := range results {
+		if res.err != nil {
+			return false, "", res.err
+		}
+		if !res.clean {
+			clean = false
+			if detail == "" {
+				detail = res.detail
+			}
+		}
+	}
+	return clean, detail, nil
+}
+
+// auditLog дописывает сработавшую проверку безопасности в audit.log рядом
+// с остальным хранилищем узла, чтобы событие не терялось вместе с логом
+// процесса и его можно было разобрать отдельно
+func (n *Node) auditLog(filename, detail string) {
+	path := filepath.Join(n.StorageDir, "audit.log")
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		log.Printf("⚠️  Не удалось открыть audit-лог: %v", err)
+		return
+	}
+	defer f.Close()
+
+	entry := struct {
+		Time   string `json:"time"`
+		File   string `json:"file"`
+		Detail string `json:"detail"`
+	}{
+		Time:   time.Now().Format(time.RFC3339),
+		File:   filename,
+		Detail: detail,
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	f.Write(append(data, '\n'))
+}
+
+// --- ClamAV ---
+
+// ClamAVScanner проверяет файлы через демон clamd по протоколу INSTREAM:
+// содержимое передаётся кусками, каждый из которых предваряется 4 байтами
+// длины в big-endian, а конец потока отмечается чанком нулевой длины
+type ClamAVScanner struct {
+	Addr    string // адрес clamd, например "127.0.0.1:3310"
+	Timeout time.Duration
+}
+
+// NewClamAVScanner создаёт сканер, обращающийся к clamd по addr
+func NewClamAVScanner(addr string) *ClamAVScanner {
+	return &ClamAVScanner{Addr: addr, Timeout: 30 * time.Second}
+}
+
+func (c *ClamAVScanner) Scan(name string, r io.Reader) (bool, string, error) {
+	conn, err := net.DialTimeout("tcp", c.Addr, c.Timeout)
+	if err != nil {
+		return false, "", fmt.Errorf("не удалось подключиться к clamd: %w", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(c.Timeout))
+
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return false, "", err
+	}
+
+	buf := make([]byte, 8192)
+	for {
+		n, rerr := r.Read(buf)
+		if n > 0 {
+			var size [4]byte
+			binary.BigEndian.PutUint32(size[:], uint32(n))
+			if _, err := conn.Write(size[:]); err != nil {
+				return false, "", err
+			}
+			if _, err := conn.Write(buf[:n]); err != nil {
+				return false, "", err
+			}
+		}
+		if rerr == io.EOF {
+			break
+		}
+		if rerr != nil {
+			return false, "", rerr
+		}
+	}
+
+	// Чанк нулевой длины сигнализирует clamd о конце потока
+	if _, err := conn.Write([]byte{0, 0, 0, 0}); err != nil {
+		return false, "", err
+	}
+
+	resp, err := io.ReadAll(conn)
+	if err != nil {
+		return false, "", err
+	}
+
+	reply := strings.TrimRight(string(resp), "\x00\r\n")
+	switch {
+	case strings.HasSuffix(reply, "FOUND"):
+		return false, reply, nil
+	case strings.Contains(reply, "OK"):
+		return true, "", nil
+	default:
+		return false, "", fmt.Errorf("неожиданный ответ clamd: %s", reply)
+	}
+}
+
+// --- VirusTotal ---
+
+// VirusTotalScanner отправляет файл в VirusTotal Files API и считает его
+// заражённым, если хотя бы один антивирусный движок сообщил об обнаружении.
+// POST /files асинхронен и в ответ отдаёт только идентификатор анализа, а
+// не готовую статистику — её приходится дожидаться отдельным опросом
+// GET /analyses/<id>, пока VirusTotal не закончит проверку всеми движками
+type VirusTotalScanner struct {
+	APIKey       string
+	HTTPClient   *http.Client
+	PollInterval time.Duration // пауза между опросами /analyses/<id>
+	PollTimeout  time.Duration // сколько всего ждать завершения анализа, прежде чем сдаться
+}
+
+// NewVirusTotalScanner создаёт сканер, авторизующийся ключом apiKey
+func NewVirusTotalScanner(apiKey string) *VirusTotalScanner {
+	return &VirusTotalScanner{
+		APIKey:       apiKey,
+		HTTPClient:   &http.Client{Timeout: 30 * time.Second},
+		PollInterval: 15 * time.Second,
+		PollTimeout:  3 * time.Minute,
+	}
+}
+
+// virusTotalSubmitResponse — ответ на POST /files: самого результата
+// анализа в нём нет, только id, по которому его нужно опрашивать
+type virusTotalSubmitResponse struct {
+	Data struct {
+		ID string `json:"id"`
+	} `json:"data"`
+}
+
+// virusTotalAnalysisResponse — ответ на GET /analyses/<id>: Status
+// переходит из "queued"/"in progress" в "completed", и только тогда Stats
+// содержит итоговые детекты
+type virusTotalAnalysisResponse struct {
+	Data struct {
+		Attributes struct {
+			Status string `json:"status"`
+			Stats  struct {
+				Malicious  int `json:"malicious"`
+				Suspicious int `json:"suspicious"`
+			} `json:"stats"`
+		} `json:"attributes"`
+	} `json:"data"`
+}
+
+func (v *VirusTotalScanner) Scan(name string, r io.Reader) (bool, string, error) {
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	part, err := writer.CreateFormFile("file", name)
+	if err != nil {
+		return false, "", err
+	}
+	if _, err := io.Copy(part, r); err != nil {
+		return false, "", err
+	}
+	if err := writer.Close(); err != nil {
+		return false, "", err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, "https://www.virustotal.com/api/v3/files", &body)
+	if err != nil {
+		return false, "", err
+	}
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	req.Header.Set("x-apikey", v.APIKey)
+
+	resp, err := v.HTTPClient.Do(req)
+	if err != nil {
+		return false, "", fmt.Errorf("запрос к VirusTotal не удался: %w", err)
+	}
+
+	var submitted virusTotalSubmitResponse
+	derr := json.NewDecoder(resp.Body).Decode(&submitted)
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return false, "", fmt.Errorf("VirusTotal вернул статус %d", resp.StatusCode)
+	}
+	if derr != nil {
+		return false, "", derr
+	}
+	if submitted.Data.ID == "" {
+		return false, "", fmt.Errorf("VirusTotal не вернул id анализа")
+	}
+
+	return v.pollAnalysis(submitted.Data.ID)
+}
+
+// pollAnalysis опрашивает GET /analyses/<id>, пока VirusTotal не закончит
+// анализ всеми движками, и сообщает о заражении, если хотя бы один из них
+// сообщил об обнаружении. Если анализ не завершается за PollTimeout, сканер
+// fail closed — возвращает ошибку, а не «чисто»
+func (v *VirusTotalScanner) pollAnalysis(id string) (bool, string, error) {
+	deadline := time.Now().Add(v.PollTimeout)
+
+	for {
+		req, err := http.NewRequest(http.MethodGet, "https://www.virustotal.com/api/v3/analyses/"+id, nil)
+		if err != nil {
+			return false, "", err
+		}
+		req.Header.Set("x-apikey", v.APIKey)
+
+		resp, err := v.HTTPClient.Do(req)
+		if err != nil {
+			return false, "", fmt.Errorf("запрос статуса анализа VirusTotal не удался: %w", err)
+		}
+
+		var result virusTotalAnalysisResponse
+		derr := json.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			return false, "", fmt.Errorf("VirusTotal вернул статус %d при опросе анализа", resp.StatusCode)
+		}
+		if derr != nil {
+			return false, "", derr
+		}
+
+		if result.Data.Attributes.Status == "completed" {
+			stats := result.Data.Attributes.Stats
+			if stats.Malicious > 0 || stats.Suspicious > 0 {
+				return false, fmt.Sprintf("VirusTotal: %d детектов, %d подозрений", stats.Malicious, stats.Suspicious), nil
+			}
+			return true, "", nil
+		}
+
+		if time.Now().After(deadline) {
+			return false, "", fmt.Errorf("VirusTotal не завершил анализ за %s", v.PollTimeout)
+		}
+		time.Sleep(v.PollInterval)
+	}
+}
@@ -1,86 +1,466 @@
 package main
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 )
 
-// Storage управляет локальным хранилищем файлов
+// ChunkSize — размер одного чанка при разбиении файла на части (4 МБ)
+const ChunkSize = 4 << 20
+
+// Manifest описывает файл как упорядоченный список хэшей его чанков
+// плюс корень Меркла над этим списком, по которому удобно сравнивать
+// версии файла между узлами, не перекачивая сам файл. Version и Deleted
+// используются gossip-синхронизацией (см. gossip.go) для разрешения
+// конкурентных записей и распространения удалений
+type Manifest struct {
+	Name        string          `json:"name"`
+	Size        int64           `json:"size"`
+	ChunkHashes []string        `json:"chunk_hashes"`
+	MerkleRoot  string          `json:"merkle_root"`
+	Shards      *ShardPlacement `json:"shards,omitempty"`
+	Version     Version         `json:"version"`
+	Deleted     bool            `json:"deleted,omitempty"`
+	DeletedAt   int64           `json:"deleted_at,omitempty"` // unix-время, когда появился tombstone
+	ModTime     int64           `json:"mod_time"`             // unix-время записи файла, используется для If-Modified-Since (см. handleDownload)
+}
+
+// Storage управляет локальным хранилищем файлов. Содержимое файлов
+// хранится content-addressable чанками в chunks/, а поверх них лежат
+// манифесты в manifests/, описывающие, из каких чанков собран файл
 type Storage struct {
-	BaseDir string // Базовая директория для хранения
+	BaseDir              string        // Базовая директория для хранения
+	NodeID               string        // ID узла, которому принадлежит это хранилище (для Version)
+	TombstoneGracePeriod time.Duration // Как долго хранить tombstone перед вычисткой
+
+	mu      sync.Mutex
+	lamport int64 // Lamport-счётчик для версионирования локальных записей
+
+	uploadsMu   sync.Mutex             // Защищает uploadLocks (см. lockUpload в upload.go)
+	uploadLocks map[string]*sync.Mutex // Мьютекс на каждый id резюмируемой загрузки
 }
 
 // NewStorage создаёт новый экземпляр хранилища
-func NewStorage(baseDir string) *Storage {
-	return &Storage{
-		BaseDir: baseDir,
+func NewStorage(baseDir, nodeID string) *Storage {
+	s := &Storage{
+		BaseDir:              baseDir,
+		NodeID:               nodeID,
+		TombstoneGracePeriod: DefaultTombstoneGracePeriod,
+		uploadLocks:          make(map[string]*sync.Mutex),
+	}
+	os.MkdirAll(s.chunksDir(), 0755)
+	os.MkdirAll(s.manifestsDir(), 0755)
+	return s
+}
+
+// nextVersion выставляет новую локальную версию, продвигая Lamport-счётчик
+func (s *Storage) nextVersion() Version {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lamport++
+	return Version{Lamport: s.lamport, NodeID: s.NodeID}
+}
+
+// witnessVersion продвигает локальный Lamport-счётчик, если увиденная
+// версия соседа новее, — стандартное правило часов Лампорта при получении
+// сообщения: local = max(local, received)
+func (s *Storage) witnessVersion(v Version) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if v.Lamport > s.lamport {
+		s.lamport = v.Lamport
 	}
 }
 
-// SaveFile сохраняет файл в локальное хранилище
+func (s *Storage) chunksDir() string {
+	return filepath.Join(s.BaseDir, "chunks")
+}
+
+func (s *Storage) manifestsDir() string {
+	return filepath.Join(s.BaseDir, "manifests")
+}
+
+// chunkPath возвращает путь чанка на диске, раскладывая их по первым
+// двум символам хэша, чтобы не держать сотни тысяч файлов в одной директории
+func (s *Storage) chunkPath(hash string) string {
+	return filepath.Join(s.chunksDir(), hash[:2], hash)
+}
+
+func (s *Storage) manifestPath(filename string) string {
+	return filepath.Join(s.manifestsDir(), filename+".json")
+}
+
+// SaveFile разбивает содержимое reader на чанки по ChunkSize, сохраняет
+// каждый чанк под его SHA-256 хэшем (одинаковые чанки в разных файлах
+// хранятся один раз) и записывает манифест с новой локальной версией.
+// Используется для собственных загрузок этого узла — для кэширования
+// файла, уже версионированного другим узлом, см. CacheFile
 func (s *Storage) SaveFile(filename string, reader io.Reader) error {
-	// Создаём полный путь к файлу
-	// filepath.Join автоматически использует правильные разделители для ОС
-	filePath := filepath.Join(s.BaseDir, filename)
+	hashes, size, merkleRoot, err := s.writeChunks(reader)
+	if err != nil {
+		return err
+	}
+
+	return s.saveManifest(Manifest{
+		Name:        filename,
+		Size:        size,
+		ChunkHashes: hashes,
+		MerkleRoot:  merkleRoot,
+		Version:     s.nextVersion(),
+		ModTime:     time.Now().Unix(),
+	})
+}
 
-	// Создаём файл на диске
-	// os.Create создаёт новый файл или обрезает существующий
-	dst, err := os.Create(filePath)
+// CacheFile сохраняет содержимое файла вместе с манифестом, уже
+// полученным от другого узла (например, при докачке или восстановлении
+// из erasure-шардов), сохраняя его Version и Shards как есть — в отличие
+// от SaveFile это не новая запись, а локальная копия чужой версии
+func (s *Storage) CacheFile(manifest Manifest, reader io.Reader) error {
+	hashes, size, merkleRoot, err := s.writeChunks(reader)
 	if err != nil {
 		return err
 	}
-	defer dst.Close()
 
-	// Копируем данные из reader в файл
-	// io.Copy эффективно копирует данные небольшими порциями
-	_, err = io.Copy(dst, reader)
+	manifest.ChunkHashes = hashes
+	manifest.Size = size
+	manifest.MerkleRoot = merkleRoot
+	return s.saveManifest(manifest)
+}
+
+// writeChunks разбивает содержимое reader на чанки по ChunkSize и
+// сохраняет каждый на диск под его SHA-256 хэшем
+func (s *Storage) writeChunks(reader io.Reader) (hashes []string, size int64, merkleRoot string, err error) {
+	buf := make([]byte, ChunkSize)
+	for {
+		n, rerr := io.ReadFull(reader, buf)
+		if n > 0 {
+			hash, werr := s.writeChunk(buf[:n])
+			if werr != nil {
+				return nil, 0, "", werr
+			}
+			hashes = append(hashes, hash)
+			size += int64(n)
+		}
+		if rerr == io.EOF || rerr == io.ErrUnexpectedEOF {
+			break
+		}
+		if rerr != nil {
+			return nil, 0, "", rerr
+		}
+	}
+	return hashes, size, computeMerkleRoot(hashes), nil
+}
+
+// writeChunk сохраняет чанк на диск под его SHA-256 хэшем, если его там
+// ещё нет, и возвращает этот хэш
+func (s *Storage) writeChunk(data []byte) (string, error) {
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+	path := s.chunkPath(hash)
+
+	// Чанк с таким хэшем уже есть на диске — дедупликация, писать не нужно
+	if _, err := os.Stat(path); err == nil {
+		return hash, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", err
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return "", err
+	}
+	return hash, os.Rename(tmp, path)
+}
+
+// HasChunk проверяет, есть ли чанк с данным хэшем в локальном хранилище
+func (s *Storage) HasChunk(hash string) bool {
+	_, err := os.Stat(s.chunkPath(hash))
+	return err == nil
+}
+
+// ReadChunk читает содержимое чанка по его хэшу
+func (s *Storage) ReadChunk(hash string) ([]byte, error) {
+	return os.ReadFile(s.chunkPath(hash))
+}
+
+// WriteChunk сохраняет присланный другим узлом чанк, предварительно
+// проверяя, что его содержимое действительно соответствует хэшу
+func (s *Storage) WriteChunk(hash string, data []byte) error {
+	sum := sha256.Sum256(data)
+	if hex.EncodeToString(sum[:]) != hash {
+		return fmt.Errorf("содержимое чанка не соответствует хэшу %s", hash)
+	}
+	_, err := s.writeChunk(data)
 	return err
 }
 
-// GetFile возвращает файл для чтения
-func (s *Storage) GetFile(filename string) (*os.File, error) {
-	filePath := filepath.Join(s.BaseDir, filename)
-	
-	// Открываем файл только для чтения
-	return os.Open(filePath)
+// saveManifest записывает манифест на диск через временный файл и
+// атомарное переименование, чтобы читатели никогда не видели частично
+// записанный манифест
+func (s *Storage) saveManifest(m Manifest) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(s.manifestsDir(), 0755); err != nil {
+		return err
+	}
+
+	path := s.manifestPath(m.Name)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
 }
 
-// ListFiles возвращает список всех файлов в хранилище
-func (s *Storage) ListFiles() ([]FileInfo, error) {
-	var files []FileInfo
+// LoadManifest читает манифест файла по его имени
+func (s *Storage) LoadManifest(filename string) (Manifest, error) {
+	var m Manifest
+	data, err := os.ReadFile(s.manifestPath(filename))
+	if err != nil {
+		return m, err
+	}
+	err = json.Unmarshal(data, &m)
+	return m, err
+}
 
-	// Читаем содержимое директории
-	entries, err := os.ReadDir(s.BaseDir)
+// AllManifests возвращает манифесты всех файлов в хранилище, ключ — имя файла
+func (s *Storage) AllManifests() (map[string]Manifest, error) {
+	entries, err := os.ReadDir(s.manifestsDir())
 	if err != nil {
+		if os.IsNotExist(err) {
+			return map[string]Manifest{}, nil
+		}
 		return nil, err
 	}
 
-	// Проходим по всем файлам в директории
+	manifests := make(map[string]Manifest, len(entries))
 	for _, entry := range entries {
-		// Пропускаем поддиректории
 		if entry.IsDir() {
 			continue
 		}
-
-		// Получаем информацию о файле
-		info, err := entry.Info()
+		name := strings.TrimSuffix(entry.Name(), ".json")
+		m, err := s.LoadManifest(name)
 		if err != nil {
 			continue
 		}
+		manifests[m.Name] = m
+	}
+	return manifests, nil
+}
+
+// ReadSeekCloser — io.ReadCloser, который вдобавок умеет Seek. Нужен,
+// чтобы отдавать локальные файлы через http.ServeContent: без Seek он не
+// смог бы ни определить Content-Length, ни обслужить Range-запросы
+type ReadSeekCloser interface {
+	io.Reader
+	io.Seeker
+	io.Closer
+}
 
-		// Добавляем файл в список
-		files = append(files, FileInfo{
-			Name: entry.Name(),
-			Size: info.Size(),
-		})
+// GetFile возвращает файл для чтения, пересобирая его из чанков на лету.
+// Для удалённого (tombstone) файла ведёт себя так, будто файла не существует
+func (s *Storage) GetFile(filename string) (ReadSeekCloser, error) {
+	manifest, err := s.LoadManifest(filename)
+	if err != nil {
+		return nil, err
+	}
+	if manifest.Deleted {
+		return nil, fmt.Errorf("файл %s удалён", filename)
+	}
+	return newChunkReader(s, manifest), nil
+}
+
+// ListFiles возвращает список всех файлов в хранилище, не считая
+// удалённых (за которыми остался tombstone)
+func (s *Storage) ListFiles() ([]FileInfo, error) {
+	manifests, err := s.AllManifests()
+	if err != nil {
+		return nil, err
 	}
 
+	var files []FileInfo
+	for _, m := range manifests {
+		if m.Deleted {
+			continue
+		}
+		files = append(files, FileInfo{Name: m.Name, Size: m.Size})
+	}
 	return files, nil
 }
 
-// DeleteFile удаляет файл из хранилища
-func (s *Storage) DeleteFile(filename string) error {
-	filePath := filepath.Join(s.BaseDir, filename)
-	return os.Remove(filePath)
-}
\ No newline at end of file
+// DeleteFile не стирает файл немедленно, а заменяет его манифест
+// tombstone-записью с новой версией. Tombstone хранится TombstoneGracePeriod,
+// чтобы успеть разойтись по gossip-обмену до всех узлов, после чего его
+// может убрать PurgeExpiredTombstones. Сами чанки не удаляются, так как
+// могут использоваться другими файлами
+func (s *Storage) DeleteFile(filename string, deletedAt time.Time) (Manifest, error) {
+	manifest, err := s.LoadManifest(filename)
+	if err != nil {
+		manifest = Manifest{Name: filename}
+	}
+
+	manifest.Deleted = true
+	manifest.DeletedAt = deletedAt.Unix()
+	manifest.Version = s.nextVersion()
+
+	if err := s.saveManifest(manifest); err != nil {
+		return Manifest{}, err
+	}
+	return manifest, nil
+}
+
+// RemoveLocalFile убирает манифест файла из локального хранилища без
+// tombstone и без версионирования — используется, когда этот узел перестал
+// быть одним из HRW-владельцев файла (см. rebalance в ring.go), а остальные
+// узлы по-прежнему хранят свои копии, так что рассылать удаление не нужно
+func (s *Storage) RemoveLocalFile(filename string) error {
+	if err := os.Remove(s.manifestPath(filename)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// PurgeExpiredTombstones окончательно убирает манифесты-tombstone старше
+// TombstoneGracePeriod
+func (s *Storage) PurgeExpiredTombstones(now time.Time) error {
+	manifests, err := s.AllManifests()
+	if err != nil {
+		return err
+	}
+
+	for _, m := range manifests {
+		if !m.Deleted {
+			continue
+		}
+		if now.Sub(time.Unix(m.DeletedAt, 0)) > s.TombstoneGracePeriod {
+			os.Remove(s.manifestPath(m.Name))
+		}
+	}
+	return nil
+}
+
+// computeMerkleRoot строит корень дерева Меркла над списком хэшей чанков,
+// чтобы можно было одним значением сравнить версии файла у двух узлов
+func computeMerkleRoot(hashes []string) string {
+	if len(hashes) == 0 {
+		return ""
+	}
+
+	level := make([][]byte, len(hashes))
+	for i, h := range hashes {
+		b, _ := hex.DecodeString(h)
+		level[i] = b
+	}
+
+	for len(level) > 1 {
+		var next [][]byte
+		for i := 0; i < len(level); i += 2 {
+			if i+1 < len(level) {
+				sum := sha256.Sum256(append(level[i], level[i+1]...))
+				next = append(next, sum[:])
+			} else {
+				next = append(next, level[i])
+			}
+		}
+		level = next
+	}
+
+	return hex.EncodeToString(level[0])
+}
+
+// chunkReader последовательно отдаёт содержимое чанков файла как единый
+// io.Reader, не загружая файл целиком в память. Seek переставляет позицию
+// чтения, пересчитывая номер чанка и смещение внутри него, так как все
+// чанки, кроме последнего, имеют одинаковый размер ChunkSize
+type chunkReader struct {
+	storage *Storage
+	hashes  []string
+	size    int64
+
+	pos     int64
+	index   int
+	skip    int64 // сколько байт пропустить в начале следующего подгружаемого чанка после Seek
+	current io.Reader
+}
+
+func newChunkReader(s *Storage, manifest Manifest) *chunkReader {
+	return &chunkReader{storage: s, hashes: manifest.ChunkHashes, size: manifest.Size}
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	for {
+		if c.current == nil {
+			if c.index >= len(c.hashes) {
+				return 0, io.EOF
+			}
+			data, err := c.storage.ReadChunk(c.hashes[c.index])
+			if err != nil {
+				return 0, err
+			}
+			c.index++
+
+			if c.skip > 0 {
+				if c.skip >= int64(len(data)) {
+					c.skip -= int64(len(data))
+					continue
+				}
+				data = data[c.skip:]
+				c.skip = 0
+			}
+			c.current = bytes.NewReader(data)
+		}
+
+		n, err := c.current.Read(p)
+		c.pos += int64(n)
+		if err == io.EOF {
+			c.current = nil
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+// Seek реализует io.Seeker поверх чанкового хранилища: вместо перечитывания
+// файла с начала сразу вычисляет, какой чанк содержит нужное смещение
+func (c *chunkReader) Seek(offset int64, whence int) (int64, error) {
+	var abs int64
+	switch whence {
+	case io.SeekStart:
+		abs = offset
+	case io.SeekCurrent:
+		abs = c.pos + offset
+	case io.SeekEnd:
+		abs = c.size + offset
+	default:
+		return 0, fmt.Errorf("некорректный whence: %d", whence)
+	}
+	if abs < 0 {
+		return 0, fmt.Errorf("отрицательная позиция чтения")
+	}
+
+	c.pos = abs
+	c.index = int(abs / ChunkSize)
+	c.skip = abs % ChunkSize
+	c.current = nil
+	return abs, nil
+}
+
+func (c *chunkReader) Close() error {
+	return nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"testing"
+)
+
+// TestComputeMerkleRoot проверяет, что корень Меркла зависит от порядка и
+// содержимого хэшей чанков, а для одного чанка совпадает с ним самим
+func TestComputeMerkleRoot(t *testing.T) {
+	if got := computeMerkleRoot(nil); got != "" {
+		t.Fatalf("пустой список чанков должен давать пустой корень, получили %q", got)
+	}
+
+	single := []string{"aa"}
+	if got := computeMerkleRoot(single); got != "aa" {
+		t.Fatalf("один чанк должен давать корень, равный самому хэшу: получили %q", got)
+	}
+
+	a := computeMerkleRoot([]string{"aa", "bb", "cc"})
+	b := computeMerkleRoot([]string{"bb", "aa", "cc"})
+	if a == b {
+		t.Fatalf("перестановка чанков должна менять корень Меркла")
+	}
+
+	if computeMerkleRoot([]string{"aa", "bb", "cc"}) != a {
+		t.Fatalf("корень Меркла должен быть детерминированным для одного и того же списка")
+	}
+}
+
+// TestChunkReaderSeek проверяет, что Seek поверх chunkReader корректно
+// пересчитывает номер чанка и смещение внутри него на границах ChunkSize
+func TestChunkReaderSeek(t *testing.T) {
+	dir, err := os.MkdirTemp("", "chunkreader-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := NewStorage(dir, "test-node")
+
+	content := make([]byte, ChunkSize+100)
+	for i := range content {
+		content[i] = byte(i % 256)
+	}
+
+	if err := s.SaveFile("big.bin", bytes.NewReader(content)); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := s.GetFile("big.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	// Смещение внутри первого чанка
+	if _, err := f.Seek(10, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, 5)
+	if _, err := io.ReadFull(f, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, content[10:15]) {
+		t.Fatalf("Seek внутри первого чанка: получили %v, ожидали %v", got, content[10:15])
+	}
+
+	// Смещение сразу за границей первого чанка, во втором чанке
+	if _, err := f.Seek(ChunkSize+10, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	got = make([]byte, 5)
+	if _, err := io.ReadFull(f, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, content[ChunkSize+10:ChunkSize+15]) {
+		t.Fatalf("Seek во втором чанке: получили %v, ожидали %v", got, content[ChunkSize+10:ChunkSize+15])
+	}
+
+	// SeekEnd: последние 10 байт файла
+	if _, err := f.Seek(-10, io.SeekEnd); err != nil {
+		t.Fatal(err)
+	}
+	rest, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(rest, content[len(content)-10:]) {
+		t.Fatalf("Seek от конца файла: получили %v, ожидали %v", rest, content[len(content)-10:])
+	}
+}
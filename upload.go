@@ -0,0 +1,322 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Этот файл реализует упрощённый вариант протокола резюмируемой
+// загрузки tus (https://tus.io/): клиент создаёт загрузку через
+// POST /files, затем дозаписывает данные через PATCH /files/<id> по
+// смещению Upload-Offset, что позволяет продолжить прерванную передачу
+// большого файла вместо того, чтобы начинать её заново. Существующий
+// /upload остаётся для простых небольших файлов.
+
+// uploadMeta хранит прогресс одной незавершённой резюмируемой загрузки
+type uploadMeta struct {
+	Filename string `json:"filename"`
+	Length   int64  `json:"length"`
+	Offset   int64  `json:"offset"`
+}
+
+func (s *Storage) partialsDir() string {
+	return filepath.Join(s.BaseDir, "partials")
+}
+
+func (s *Storage) partialDataPath(id string) string {
+	return filepath.Join(s.partialsDir(), id+".partial")
+}
+
+func (s *Storage) partialMetaPath(id string) string {
+	return filepath.Join(s.partialsDir(), id+".json")
+}
+
+// CreateUpload заводит новую резюмируемую загрузку заданной длины и
+// возвращает её идентификатор
+func (s *Storage) CreateUpload(filename string, length int64) (string, error) {
+	if err := os.MkdirAll(s.partialsDir(), 0755); err != nil {
+		return "", err
+	}
+
+	id, err := generateUploadID()
+	if err != nil {
+		return "", err
+	}
+
+	f, err := os.Create(s.partialDataPath(id))
+	if err != nil {
+		return "", err
+	}
+	f.Close()
+
+	meta := uploadMeta{Filename: filename, Length: length, Offset: 0}
+	if err := s.savePartialMeta(id, meta); err != nil {
+		return "", err
+	}
+
+	return id, nil
+}
+
+// UploadStatus возвращает текущее и конечное смещение резюмируемой загрузки
+func (s *Storage) UploadStatus(id string) (offset int64, length int64, err error) {
+	meta, err := s.loadPartialMeta(id)
+	if err != nil {
+		return 0, 0, err
+	}
+	return meta.Offset, meta.Length, nil
+}
+
+// AppendToUpload дозаписывает данные из r в загрузку id начиная с offset.
+// Накопленные данные просто дописываются в файл частичной загрузки; когда
+// они достигают заявленной длины, done сообщает об этом вызывающей
+// стороне, которая и завершает загрузку (см. finalizeTusUpload ниже в этом файле —
+// там же проверка содержимого и HRW-владение, как и при обычной загрузке
+// через /upload)
+func (s *Storage) AppendToUpload(id string, offset int64, r io.Reader) (newOffset int64, done bool, meta uploadMeta, err error) {
+	unlock := s.lockUpload(id)
+	defer unlock()
+
+	meta, err = s.loadPartialMeta(id)
+	if err != nil {
+		return 0, false, uploadMeta{}, err
+	}
+
+	if offset != meta.Offset {
+		return 0, false, uploadMeta{}, fmt.Errorf("смещение не совпадает: ожидалось %d, получено %d", meta.Offset, offset)
+	}
+
+	f, err := os.OpenFile(s.partialDataPath(id), os.O_WRONLY, 0644)
+	if err != nil {
+		return 0, false, uploadMeta{}, err
+	}
+	defer f.Close()
+
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return 0, false, uploadMeta{}, err
+	}
+
+	written, err := io.Copy(f, r)
+	if err != nil {
+		return 0, false, uploadMeta{}, err
+	}
+
+	meta.Offset += written
+	if err := s.savePartialMeta(id, meta); err != nil {
+		return 0, false, uploadMeta{}, err
+	}
+
+	return meta.Offset, meta.Offset >= meta.Length, meta, nil
+}
+
+// lockUpload возвращает мьютекс, выделенный конкретному id резюмируемой
+// загрузки, и функцию его освобождения. Два одновременных PATCH с одним и
+// тем же id (например, повтор клиента после оборвавшегося соединения)
+// иначе читали бы один и тот же meta.Offset и писали бы в файл параллельно,
+// из-за чего данные могли бы потеряться или повредиться — сериализуем их
+func (s *Storage) lockUpload(id string) func() {
+	s.uploadsMu.Lock()
+	lock, ok := s.uploadLocks[id]
+	if !ok {
+		lock = &sync.Mutex{}
+		s.uploadLocks[id] = lock
+	}
+	s.uploadsMu.Unlock()
+
+	lock.Lock()
+	return lock.Unlock
+}
+
+// removePartialFiles убирает временные файлы резюмируемой загрузки после её
+// завершения или отклонения сканером, а также освобождает её per-id мьютекс
+func (s *Storage) removePartialFiles(id string) {
+	os.Remove(s.partialDataPath(id))
+	os.Remove(s.partialMetaPath(id))
+
+	s.uploadsMu.Lock()
+	delete(s.uploadLocks, id)
+	s.uploadsMu.Unlock()
+}
+
+func (s *Storage) savePartialMeta(id string, meta uploadMeta) error {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(s.partialMetaPath(id), data, 0644)
+}
+
+func (s *Storage) loadPartialMeta(id string) (uploadMeta, error) {
+	var meta uploadMeta
+	data, err := os.ReadFile(s.partialMetaPath(id))
+	if err != nil {
+		return meta, err
+	}
+	err = json.Unmarshal(data, &meta)
+	return meta, err
+}
+
+// generateUploadID возвращает случайный идентификатор загрузки
+func generateUploadID() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// handleFilesCreate обрабатывает POST /files — создание новой резюмируемой
+// загрузки по протоколу tus
+func (n *Node) handleFilesCreate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Только POST метод разрешён", http.StatusMethodNotAllowed)
+		return
+	}
+
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		http.Error(w, "Некорректный заголовок Upload-Length", http.StatusBadRequest)
+		return
+	}
+
+	filename, err := parseUploadFilename(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	id, err := n.Storage.CreateUpload(filename, length)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Ошибка создания загрузки: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("📝 Создана резюмируемая загрузка %s для файла %s (%d байт)", id, filename, length)
+
+	w.Header().Set("Location", "/files/"+id)
+	w.Header().Set("Upload-Offset", "0")
+	w.WriteHeader(http.StatusCreated)
+}
+
+// handleFilesByID обрабатывает HEAD/PATCH /files/<id> — опрос прогресса
+// и дозапись данных резюмируемой загрузки, а также DELETE /files/<name>,
+// которым клиент удаляет уже загруженный файл (см. handleFileDelete)
+func (n *Node) handleFilesByID(w http.ResponseWriter, r *http.Request) {
+	id := filepath.Base(r.URL.Path)
+
+	switch r.Method {
+	case http.MethodDelete:
+		n.handleFileDelete(w, id)
+
+	case http.MethodHead:
+		offset, length, err := n.Storage.UploadStatus(id)
+		if err != nil {
+			http.Error(w, "Загрузка не найдена", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+		w.Header().Set("Upload-Length", strconv.FormatInt(length, 10))
+		w.WriteHeader(http.StatusOK)
+
+	case http.MethodPatch:
+		if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+			http.Error(w, "Ожидается Content-Type: application/offset+octet-stream", http.StatusBadRequest)
+			return
+		}
+
+		offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+		if err != nil || offset < 0 {
+			http.Error(w, "Некорректный заголовок Upload-Offset", http.StatusBadRequest)
+			return
+		}
+
+		newOffset, done, meta, err := n.Storage.AppendToUpload(id, offset, r.Body)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Ошибка записи данных: %v", err), http.StatusConflict)
+			return
+		}
+
+		if done {
+			if err := n.finalizeTusUpload(id, meta); err != nil {
+				http.Error(w, fmt.Sprintf("Ошибка завершения загрузки: %v", err), http.StatusUnprocessableEntity)
+				return
+			}
+			log.Printf("✅ Резюмируемая загрузка завершена: %s", meta.Filename)
+			go n.replicateFile(meta.Filename)
+		}
+
+		w.Header().Set("Upload-Offset", strconv.FormatInt(newOffset, 10))
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Метод не поддерживается", http.StatusMethodNotAllowed)
+	}
+}
+
+// finalizeTusUpload завершает резюмируемую загрузку так же, как handleUpload
+// завершает обычную: прогоняет накопленные данные через настроенные сканеры
+// (см. scan.go) и, если файл по HRW-рейтингу не наш, проксирует его на
+// владельца вместо Storage.SaveFile — без этого /files полностью обходил бы
+// обе проверки, которым подчиняется /upload
+func (n *Node) finalizeTusUpload(id string, meta uploadMeta) error {
+	if len(n.Scanners) > 0 {
+		clean, detail, err := n.runScanners(meta.Filename, func() (io.ReadCloser, error) {
+			return os.Open(n.Storage.partialDataPath(id))
+		})
+		if err != nil {
+			return fmt.Errorf("ошибка проверки файла: %w", err)
+		}
+		if !clean {
+			n.auditLog(meta.Filename, detail)
+			log.Printf("🚫 Резюмируемая загрузка отклонена сканером: %s (%s)", meta.Filename, detail)
+			n.Storage.removePartialFiles(id)
+			return fmt.Errorf("файл отклонён проверкой безопасности: %s", detail)
+		}
+	}
+
+	f, err := os.Open(n.Storage.partialDataPath(id))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if !n.ownsFile(meta.Filename) {
+		primary := n.ReplicaSet(meta.Filename)[0]
+		if err := n.proxyUpload(primary, meta.Filename, f); err != nil {
+			return fmt.Errorf("ошибка проксирования загрузки на %s: %w", primary, err)
+		}
+		log.Printf("↪️  Файл %s не наш по HRW, проксирован на %s", meta.Filename, primary)
+	} else if err := n.Storage.SaveFile(meta.Filename, f); err != nil {
+		return err
+	}
+
+	n.Storage.removePartialFiles(id)
+	return nil
+}
+
+// parseUploadFilename достаёт имя файла из заголовка Upload-Metadata в
+// формате tus: "filename <base64>,key2 <base64>,..."
+func parseUploadFilename(metadata string) (string, error) {
+	for _, pair := range strings.Split(metadata, ",") {
+		parts := strings.Fields(strings.TrimSpace(pair))
+		if len(parts) != 2 || parts[0] != "filename" {
+			continue
+		}
+		decoded, err := base64.StdEncoding.DecodeString(parts[1])
+		if err != nil {
+			return "", fmt.Errorf("некорректное значение filename в Upload-Metadata")
+		}
+		return string(decoded), nil
+	}
+	return "", fmt.Errorf("заголовок Upload-Metadata должен содержать filename")
+}